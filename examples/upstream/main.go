@@ -0,0 +1,59 @@
+// Copyright 2020 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// upstream is a small price-lookup service used by gorm-http-app's /remote
+// endpoint to demonstrate distributed tracing across a service boundary.
+// newrelic.WrapHandleFunc automatically accepts the distributed trace
+// headers gorm-http-app inserts, so the two transactions show up linked in
+// New Relic.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// priceResponse is the JSON body returned by the /price endpoint.
+type priceResponse struct {
+	Code  string `json:"code"`
+	Price int    `json:"price"`
+}
+
+// prices is a small in-memory catalog standing in for a real pricing
+// service.
+var prices = map[string]int{
+	"D42": 100,
+	"F42": 200,
+}
+
+// Price handles GET /price?code=<code>, returning the price for code or a
+// default of 0 if the code is unknown.
+func Price(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("code")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(priceResponse{
+		Code:  code,
+		Price: prices[code],
+	})
+}
+
+func main() {
+	goAgent, err := newrelic.NewApplication(
+		newrelic.ConfigAppName("upstream-price-service"),
+		newrelic.ConfigFromEnvironment(),
+		newrelic.ConfigDistributedTracerEnabled(true),
+		newrelic.ConfigDebugLogger(os.Stdout),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc(newrelic.WrapHandleFunc(goAgent, "/price", Price))
+
+	log.Fatal(http.ListenAndServe(":8001", nil))
+}
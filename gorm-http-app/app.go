@@ -9,24 +9,34 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	// Import newrelic database driver as custom driver
 	// GORM will automatically use this driver as its mysql driver
 	// https://gorm.io/docs/connecting_to_the_database.html#Customize-Driver
 	_ "github.com/newrelic/go-agent/v3/integrations/nrmysql"
 
+	"github.com/iamemilio/gorm-instrumentation-demo/pkg/httplog"
+	"github.com/iamemilio/gorm-instrumentation-demo/pkg/nrgorm"
+	"github.com/iamemilio/gorm-instrumentation-demo/pkg/server"
 	"github.com/newrelic/go-agent/v3/newrelic"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
 type App struct {
-	db *gorm.DB
+	goAgent     *newrelic.Application
+	db          *gorm.DB
+	httpClient  *http.Client
+	upstreamURL string
 }
 
 type Product struct {
@@ -38,14 +48,18 @@ type Product struct {
 
 const (
 	BackendError = "backend error"
+
+	// defaultUpstreamURL is used when UPSTREAM_URL is not set in the
+	// environment; it points at examples/upstream's default address.
+	defaultUpstreamURL = "http://localhost:8001/price"
 )
 
 // handler for formatting and sending bad request messages
-func errorResponse(w http.ResponseWriter, txn *newrelic.Transaction, errorNumber int, clientError, internalError string) {
+func errorResponse(ctx context.Context, w http.ResponseWriter, txn *newrelic.Transaction, errorNumber int, clientError, internalError string) {
 	defer txn.StartSegment("errorResponse").End()
 
-	// log error locally
-	log.Println(internalError)
+	// log error locally, correlated with the transaction via httplog
+	httplog.FromContext(ctx).Error(internalError)
 
 	// send http error to client
 	// because our app sets the response number header to an error
@@ -86,7 +100,7 @@ func (app *App) Get(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		internalError := fmt.Sprintf("error parsing form during GET operation: %v", err)
-		errorResponse(w, txn, http.StatusInternalServerError, BackendError, internalError)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalError)
 		return
 	}
 
@@ -96,21 +110,20 @@ func (app *App) Get(w http.ResponseWriter, r *http.Request) {
 
 	// lookup product based on arguments
 	var product Product
-	ctx := newrelic.NewContext(context.Background(), txn)
-	gormdb := app.db.WithContext(ctx)
+	gormdb := app.db.WithContext(r.Context())
 	if code != "" {
 		err = gormdb.First(&product, "code = ?", code).Error
 	} else if name != "" {
 		err = gormdb.First(&product, "name = ?", name).Error
 	} else {
 		msg := fmt.Sprintf("bad request: either name or code must be provided for get")
-		errorResponse(w, txn, http.StatusBadRequest, msg, msg)
+		errorResponse(r.Context(), w, txn, http.StatusBadRequest, msg, msg)
 		return
 	}
 
 	if err != nil {
 		internalError := fmt.Sprintf("unable to GET product: %v", err)
-		errorResponse(w, txn, http.StatusInternalServerError, BackendError, internalError)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalError)
 	} else {
 		response := fmt.Sprintf("%s,%s: $%s", product.Name, product.Code, strconv.Itoa(product.Price))
 		okResponse(w, txn, response)
@@ -126,7 +139,7 @@ func (app *App) Add(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		internalErr := fmt.Sprintf("error parsing form when adding product: %v", err)
-		errorResponse(w, txn, http.StatusInternalServerError, BackendError, internalErr)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalErr)
 		return
 	}
 
@@ -137,19 +150,19 @@ func (app *App) Add(w http.ResponseWriter, r *http.Request) {
 
 	if code == "" || name == "" || price == "" {
 		clientError := fmt.Sprintf("bad request: code, name, and price can not be empty")
-		errorResponse(w, txn, http.StatusBadRequest, clientError, clientError)
+		errorResponse(r.Context(), w, txn, http.StatusBadRequest, clientError, clientError)
 		return
 	}
 
 	intPrice, err := strconv.Atoi(price)
 	if err != nil {
 		internalErr := fmt.Sprintf("error converting %s to an integer: %v", price, err)
-		errorResponse(w, txn, http.StatusInternalServerError, BackendError, internalErr)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalErr)
+		return
 	}
 
 	// add new product to the database
-	ctx := newrelic.NewContext(context.Background(), txn)
-	gormdb := app.db.WithContext(ctx)
+	gormdb := app.db.WithContext(r.Context())
 	err = gormdb.Create(&Product{
 		Code:  code,
 		Name:  name,
@@ -158,19 +171,55 @@ func (app *App) Add(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		internalErr := fmt.Sprintf("error creating product: %v", err)
-		errorResponse(w, txn, http.StatusInternalServerError, BackendError, internalErr)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalErr)
+		return
 	}
 
 	response := fmt.Sprintf("Added Product: {Code: %s, Name: %s, Price: %s}", code, name, price)
 	okResponse(w, txn, response)
 }
 
+// Remote demonstrates distributed tracing across a service boundary: it
+// calls the upstream price-lookup service configured by app.upstreamURL,
+// propagating the current transaction via distributed trace headers, and
+// relays the upstream response back to the caller.
 func (app *App) Remote(w http.ResponseWriter, r *http.Request) {
+	txn := newrelic.FromContext(r.Context())
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, app.upstreamURL, nil)
+	if err != nil {
+		internalError := fmt.Sprintf("error building upstream request: %v", err)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalError)
+		return
+	}
+	txn.InsertDistributedTraceHeaders(req.Header)
+
+	resp, err := app.httpClient.Do(req)
+	if err != nil {
+		internalError := fmt.Sprintf("error calling upstream service: %v", err)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalError)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		internalError := fmt.Sprintf("error reading upstream response: %v", err)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalError)
+		return
+	}
 
+	if resp.StatusCode != http.StatusOK {
+		internalError := fmt.Sprintf("upstream service returned %d: %s", resp.StatusCode, body)
+		errorResponse(r.Context(), w, txn, http.StatusBadGateway, BackendError, internalError)
+		return
+	}
+
+	okResponse(w, txn, string(body))
 }
 
 // NewApp initializes a an app object with a gorm db object and a New Relic Go agent
-func NewGORMApp(appName, connectionString string) *App {
+func NewGORMApp(goAgent *newrelic.Application, connectionString string) *App {
 	// Wrap database conneciton with GORM
 	gormdb, err := gorm.Open(mysql.New(mysql.Config{
 		DriverName: "nrmysql",
@@ -179,10 +228,46 @@ func NewGORMApp(appName, connectionString string) *App {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Register the nrgorm plugin so every query on gormdb gets a
+	// DatastoreSegment, instead of hand-wrapping each helper below.
+	if err := gormdb.Use(nrgorm.New(newrelic.DatastoreMySQL)); err != nil {
+		log.Fatal(err)
+	}
 	// Migrate the schema
 	gormdb.AutoMigrate(&Product{})
 
-	return &App{db: gormdb}
+	upstreamURL := os.Getenv("UPSTREAM_URL")
+	if upstreamURL == "" {
+		upstreamURL = defaultUpstreamURL
+	}
+
+	return &App{
+		goAgent:     goAgent,
+		db:          gormdb,
+		upstreamURL: upstreamURL,
+		httpClient: &http.Client{
+			Transport: newrelic.NewRoundTripper(http.DefaultTransport),
+		},
+	}
+}
+
+// Run starts the HTTP server on addr and blocks until ctx is canceled (e.g.
+// by SIGINT/SIGTERM), at which point it drains in-flight requests, flushes
+// the New Relic agent, and closes the underlying *sql.DB.
+func (app *App) Run(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(httplog.Wrap(app.goAgent, "/", Index))
+	mux.HandleFunc(httplog.Wrap(app.goAgent, "/add", app.Add))
+	mux.HandleFunc(httplog.Wrap(app.goAgent, "/get", app.Get))
+	mux.HandleFunc(httplog.Wrap(app.goAgent, "/remote", app.Remote))
+
+	return server.Serve(ctx, addr, mux, func() {
+		app.goAgent.Shutdown(10 * time.Second)
+
+		if sqlDB, err := app.db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
 }
 
 func main() {
@@ -200,12 +285,14 @@ func main() {
 	}
 
 	// Initialize database connection
-	app := NewGORMApp(appName, "root@/product?charset=utf8mb4&parseTime=True&loc=Local")
+	app := NewGORMApp(goAgent, "root@/product?charset=utf8mb4&parseTime=True&loc=Local")
 
-	// HTTP handlers
-	http.HandleFunc(newrelic.WrapHandleFunc(goAgent, "/", Index))
-	http.HandleFunc(newrelic.WrapHandleFunc(goAgent, "/add", app.Add))
-	http.HandleFunc(newrelic.WrapHandleFunc(goAgent, "/get", app.Get))
+	// Run until SIGINT/SIGTERM, then drain in-flight requests and flush
+	// the New Relic agent so no data is lost on shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	http.ListenAndServe(":8000", nil)
+	if err := app.Run(ctx, ":8000"); err != nil {
+		log.Fatal(err)
+	}
 }
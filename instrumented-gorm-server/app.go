@@ -8,12 +8,16 @@ package main
 
 import (
 	"context"
+	"embed"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	// Import newrelic database driver as custom driver
@@ -21,11 +25,18 @@ import (
 	// https://gorm.io/docs/connecting_to_the_database.html#Customize-Driver
 	_ "github.com/newrelic/go-agent/v3/integrations/nrmysql"
 
+	"github.com/iamemilio/gorm-instrumentation-demo/pkg/httplog"
+	"github.com/iamemilio/gorm-instrumentation-demo/pkg/migrate"
+	"github.com/iamemilio/gorm-instrumentation-demo/pkg/nrgorm"
+	"github.com/iamemilio/gorm-instrumentation-demo/pkg/server"
 	"github.com/newrelic/go-agent/v3/newrelic"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
+//go:embed migrations
+var migrationsFS embed.FS
+
 type App struct {
 	App *newrelic.Application
 	db  *gorm.DB
@@ -43,12 +54,12 @@ const (
 )
 
 // handler for formatting and sending bad request messages
-func errorResponse(w http.ResponseWriter, txn *newrelic.Transaction, errorNumber int, clientError, internalError error) {
+func errorResponse(ctx context.Context, w http.ResponseWriter, txn *newrelic.Transaction, errorNumber int, clientError, internalError error) {
 	// Observe Http response using new relic segment
 	defer txn.StartSegment("okResponse").End()
 
-	// log error locally
-	log.Println(internalError)
+	// log error locally, correlated with the transaction via httplog
+	httplog.FromContext(ctx).Error(internalError.Error())
 
 	// send http error to client
 	w.WriteHeader(errorNumber)
@@ -66,7 +77,12 @@ func okResponse(w http.ResponseWriter, txn *newrelic.Transaction, message string
 	w.Write([]byte(message))
 }
 
-func NewApp(appName, connectionString string) *App {
+// NewApp connects to the database and initializes the New Relic Go agent.
+// When runMigrations is true, the versioned migrations under migrations/
+// (each applied as its own "migrate:<version>" segment) own the schema,
+// starting from 0001_init which creates the products table; AutoMigrate
+// only runs as a fallback when runMigrations is false.
+func NewApp(appName, connectionString string, runMigrations bool) *App {
 	// Wrap database conneciton with GORM
 	gormdb, err := gorm.Open(mysql.New(mysql.Config{
 		DriverName: "nrmysql",
@@ -75,8 +91,11 @@ func NewApp(appName, connectionString string) *App {
 	if err != nil {
 		log.Fatal(err)
 	}
-	// Migrate the schema
-	gormdb.AutoMigrate(&Product{})
+	// Register the nrgorm plugin so every query on gormdb gets a
+	// DatastoreSegment, instead of hand-wrapping each helper below.
+	if err := gormdb.Use(nrgorm.New(newrelic.DatastoreMySQL)); err != nil {
+		log.Fatal(err)
+	}
 	// initialize new relic go aganet app
 	app, err := newrelic.NewApplication(
 		newrelic.ConfigAppName(appName),
@@ -90,6 +109,27 @@ func NewApp(appName, connectionString string) *App {
 
 	app.WaitForConnection(5 * time.Second)
 
+	if runMigrations {
+		sqlDB, err := gormdb.DB()
+		if err != nil {
+			log.Fatal(err)
+		}
+		migrator, err := migrate.New(sqlDB, migrationsFS, "migrations")
+		if err != nil {
+			log.Fatal(err)
+		}
+		txn := app.StartTransaction("Migrate")
+		err = migrator.Up(newrelic.NewContext(context.Background(), txn))
+		txn.End()
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		// Fall back to AutoMigrate when the versioned migrations aren't in
+		// use, so the example still works out of the box without --migrate.
+		gormdb.AutoMigrate(&Product{})
+	}
+
 	return &App{db: gormdb, App: app}
 }
 
@@ -108,15 +148,10 @@ func (app *App) Index(w http.ResponseWriter, r *http.Request) {
 }
 
 // a helper function to execute GET database transactions
-// gets the first Product that meets the provided condition
-func (app *App) getProduct(txn *newrelic.Transaction, condition, value string) (Product, error) {
-	// trace the createProduct function with a newRelic Segment
-	defer txn.StartSegment("getProduct").End()
-
-	// create a new relic context to pass to gorm to allow
-	// the go agent to observe the database transactions
-	ctx := newrelic.NewContext(context.Background(), txn)
-
+// gets the first Product that meets the provided condition. The nrgorm
+// plugin registered in NewApp reads the transaction off ctx to record the
+// DatastoreSegment, so callers just need to pass the request context through.
+func (app *App) getProduct(ctx context.Context, condition, value string) (Product, error) {
 	var product Product
 	gormdb := app.db.WithContext(ctx)
 	err := gormdb.First(&product, condition, value).Error
@@ -136,7 +171,7 @@ func (app *App) Get(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		clientError := fmt.Errorf(BackendError)
 		internalError := fmt.Errorf("error parsing form during GET operation: %v", err)
-		errorResponse(w, txn, http.StatusInternalServerError, clientError, internalError)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, clientError, internalError)
 		return
 	}
 
@@ -147,34 +182,28 @@ func (app *App) Get(w http.ResponseWriter, r *http.Request) {
 	// lookup product based on arguments
 	var product Product
 	if code != "" {
-		product, err = app.getProduct(txn, "code = ?", code)
+		product, err = app.getProduct(r.Context(), "code = ?", code)
 	} else if name != "" {
-		product, err = app.getProduct(txn, "name = ?", name)
+		product, err = app.getProduct(r.Context(), "name = ?", name)
 	} else {
 		msg := fmt.Errorf("bad request: either name or code must be provided for get")
-		errorResponse(w, txn, http.StatusBadRequest, msg, msg)
+		errorResponse(r.Context(), w, txn, http.StatusBadRequest, msg, msg)
 		return
 	}
 
 	if err != nil {
 		clientError := fmt.Errorf(BackendError)
 		internalError := fmt.Errorf("unable to GET product: %v", err)
-		errorResponse(w, txn, http.StatusInternalServerError, clientError, internalError)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, clientError, internalError)
 	} else {
 		response := fmt.Sprintf("%s,%s: $%s", product.Name, product.Code, strconv.Itoa(product.Price))
 		okResponse(w, txn, response)
 	}
 }
 
-// a helper function to execute the database create transaction
-func (app *App) createProduct(txn *newrelic.Transaction, code, name string, price int) error {
-	// trace the createProduct function with a newRelic Segment
-	defer txn.StartSegment("createProduct").End()
-
-	// create a new relic context to pass to gorm to allow
-	// the go agent to observe the database transactions
-	ctx := newrelic.NewContext(context.Background(), txn)
-
+// a helper function to execute the database create transaction. Like
+// getProduct, the nrgorm plugin observes this call via ctx.
+func (app *App) createProduct(ctx context.Context, code, name string, price int) error {
 	gormdb := app.db.WithContext(ctx)
 	err := gormdb.Create(&Product{
 		Code:  code,
@@ -197,7 +226,7 @@ func (app *App) Add(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		clientError := fmt.Errorf(BackendError)
 		internalErr := fmt.Errorf("error parsing form when adding product: %v", err)
-		errorResponse(w, txn, http.StatusInternalServerError, clientError, internalErr)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, clientError, internalErr)
 		return
 	}
 
@@ -208,7 +237,7 @@ func (app *App) Add(w http.ResponseWriter, r *http.Request) {
 
 	if code == "" || name == "" || price == "" {
 		clientError := fmt.Errorf("bad request: code, name, and price can not be empty")
-		errorResponse(w, txn, http.StatusBadRequest, clientError, clientError)
+		errorResponse(r.Context(), w, txn, http.StatusBadRequest, clientError, clientError)
 		return
 	}
 
@@ -216,33 +245,59 @@ func (app *App) Add(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		clientError := fmt.Errorf(BackendError)
 		internalErr := fmt.Errorf("error converting %s to an integer: %v", price, err)
-		errorResponse(w, txn, http.StatusInternalServerError, clientError, internalErr)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, clientError, internalErr)
+		return
 	}
 
 	// add new product to the database
-	err = app.createProduct(txn, code, name, intPrice)
+	err = app.createProduct(r.Context(), code, name, intPrice)
 	if err != nil {
 		clientError := fmt.Errorf(BackendError)
 		internalErr := fmt.Errorf("error creating product: %v", err)
-		errorResponse(w, txn, http.StatusInternalServerError, clientError, internalErr)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, clientError, internalErr)
+		return
 	}
 
 	response := fmt.Sprintf("Added Product: {Code: %s, Name: %s, Price: %s}", code, name, price)
 	okResponse(w, txn, response)
 }
 
-// a helper function that wrapps the http.handleFunc in a newrelic wrapper
-func (app *App) Handle(pattern string, handler func(http.ResponseWriter, *http.Request)) {
-	http.HandleFunc(newrelic.WrapHandleFunc(app.App, pattern, handler))
+// a helper function that wrapps the http.handleFunc in a new relic and
+// httplog wrapper
+func (app *App) Handle(mux *http.ServeMux, pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	mux.HandleFunc(httplog.Wrap(app.App, pattern, handler))
+}
+
+// Run starts the HTTP server on addr and blocks until ctx is canceled (e.g.
+// by SIGINT/SIGTERM), at which point it drains in-flight requests, flushes
+// the New Relic agent, and closes the underlying *sql.DB.
+func (app *App) Run(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	app.Handle(mux, "/", app.Index)
+	app.Handle(mux, "/add", app.Add)
+	app.Handle(mux, "/get", app.Get)
+
+	return server.Serve(ctx, addr, mux, func() {
+		app.App.Shutdown(10 * time.Second)
+
+		if sqlDB, err := app.db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
 }
 
 func main() {
-	app := NewApp("gorm-demo", "root@/product?charset=utf8mb4&parseTime=True&loc=Local")
+	runMigrations := flag.Bool("migrate", false, "apply pending database migrations before starting the server")
+	flag.Parse()
+
+	app := NewApp("gorm-demo", "root@/product?charset=utf8mb4&parseTime=True&loc=Local", *runMigrations)
 
-	// HTTP handlers
-	app.Handle("/", app.Index)
-	app.Handle("/add", app.Add)
-	app.Handle("/get", app.Get)
+	// Run until SIGINT/SIGTERM, then drain in-flight requests and flush
+	// the New Relic agent so no data is lost on shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	http.ListenAndServe(":8000", nil)
+	if err := app.Run(ctx, ":8000"); err != nil {
+		log.Fatal(err)
+	}
 }
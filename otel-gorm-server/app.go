@@ -0,0 +1,229 @@
+// Copyright 2020 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// mysql database hosted in local container for this example
+// podman run --name mysql -p 3306:3306 -e MYSQL_ALLOW_EMPTY_PASSWORD=true -e MYSQL_DATABASE="product" mysql
+//
+// This example mirrors instrumented-gorm-server, but observes the same GORM
+// CRUD flow with OpenTelemetry instead of the New Relic Go agent, so the two
+// can be compared side by side.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/iamemilio/gorm-instrumentation-demo/pkg/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	otelgorm "gorm.io/plugin/opentelemetry/tracing"
+)
+
+type App struct {
+	tracer trace.Tracer
+	db     *gorm.DB
+}
+
+type Product struct {
+	gorm.Model
+	Code  string
+	Name  string
+	Price int
+}
+
+const (
+	BackendError = "backend error"
+)
+
+// handler for formatting and sending bad request messages
+func errorResponse(ctx context.Context, tracer trace.Tracer, w http.ResponseWriter, errorNumber int, clientError, internalError error) {
+	_, span := tracer.Start(ctx, "errorResponse")
+	defer span.End()
+
+	// log error locally
+	log.Println(internalError)
+
+	// send http error to client
+	w.WriteHeader(errorNumber)
+	strError := strconv.Itoa(errorNumber)
+	response := fmt.Sprintf("%s - %s", strError, clientError)
+	w.Write([]byte(response))
+}
+
+// handler for formatting and sending ok request messages
+func okResponse(ctx context.Context, tracer trace.Tracer, w http.ResponseWriter, message string) {
+	_, span := tracer.Start(ctx, "okResponse")
+	defer span.End()
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(message))
+}
+
+// NewApp connects to the database through GORM with the otelgorm plugin
+// registered, so every query is recorded as a child span of the inbound
+// request span.
+func NewApp(tracer trace.Tracer, connectionString string) *App {
+	gormdb, err := gorm.Open(mysql.Open(connectionString), &gorm.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := gormdb.Use(otelgorm.NewPlugin()); err != nil {
+		log.Fatal(err)
+	}
+	// Migrate the schema
+	gormdb.AutoMigrate(&Product{})
+
+	return &App{db: gormdb, tracer: tracer}
+}
+
+// Index serves a static HTTP file
+func (app *App) Index(w http.ResponseWriter, r *http.Request) {
+	_, span := app.tracer.Start(r.Context(), "Index")
+	defer span.End()
+
+	p := "." + r.URL.Path
+	if p == "./" {
+		p = "./index.html"
+	}
+	http.ServeFile(w, r, p)
+}
+
+// getProduct is a helper function to execute GET database transactions.
+// It gets the first Product that meets the provided condition.
+func (app *App) getProduct(ctx context.Context, condition, value string) (Product, error) {
+	ctx, span := app.tracer.Start(ctx, "getProduct")
+	defer span.End()
+
+	var product Product
+	err := app.db.WithContext(ctx).First(&product, condition, value).Error
+
+	return product, err
+}
+
+// Get is the API endpoint for the /get pattern. It gets a single Product
+// from the database by either Name or Code.
+func (app *App) Get(w http.ResponseWriter, r *http.Request) {
+	ctx, span := app.tracer.Start(r.Context(), "Get")
+	defer span.End()
+
+	// polulate r.Form
+	err := r.ParseForm()
+	if err != nil {
+		clientError := fmt.Errorf(BackendError)
+		internalError := fmt.Errorf("error parsing form during GET operation: %v", err)
+		errorResponse(ctx, app.tracer, w, http.StatusInternalServerError, clientError, internalError)
+		return
+	}
+
+	// get arguments from http Form
+	code := r.Form.Get("code")
+	name := strings.ToLower(r.Form.Get("name"))
+
+	// lookup product based on arguments
+	var product Product
+	if code != "" {
+		product, err = app.getProduct(ctx, "code = ?", code)
+	} else if name != "" {
+		product, err = app.getProduct(ctx, "name = ?", name)
+	} else {
+		msg := fmt.Errorf("bad request: either name or code must be provided for get")
+		errorResponse(ctx, app.tracer, w, http.StatusBadRequest, msg, msg)
+		return
+	}
+
+	if err != nil {
+		clientError := fmt.Errorf(BackendError)
+		internalError := fmt.Errorf("unable to GET product: %v", err)
+		errorResponse(ctx, app.tracer, w, http.StatusInternalServerError, clientError, internalError)
+	} else {
+		response := fmt.Sprintf("%s,%s: $%s", product.Name, product.Code, strconv.Itoa(product.Price))
+		okResponse(ctx, app.tracer, w, response)
+	}
+}
+
+// createProduct is a helper function to execute the database create
+// transaction.
+func (app *App) createProduct(ctx context.Context, code, name string, price int) error {
+	ctx, span := app.tracer.Start(ctx, "createProduct")
+	defer span.End()
+
+	err := app.db.WithContext(ctx).Create(&Product{
+		Code:  code,
+		Name:  name,
+		Price: price,
+	}).Error
+
+	return err
+}
+
+// Add is the API endpoint for the /add pattern. It adds a single entry to
+// the database.
+func (app *App) Add(w http.ResponseWriter, r *http.Request) {
+	ctx, span := app.tracer.Start(r.Context(), "Add")
+	defer span.End()
+
+	// Populate r.Form
+	err := r.ParseForm()
+	if err != nil {
+		clientError := fmt.Errorf(BackendError)
+		internalErr := fmt.Errorf("error parsing form when adding product: %v", err)
+		errorResponse(ctx, app.tracer, w, http.StatusInternalServerError, clientError, internalErr)
+		return
+	}
+
+	// Parse arguments from r.Form
+	code := r.Form.Get("code")
+	name := strings.ToLower(r.Form.Get("name"))
+	price := r.Form.Get("price")
+
+	if code == "" || name == "" || price == "" {
+		clientError := fmt.Errorf("bad request: code, name, and price can not be empty")
+		errorResponse(ctx, app.tracer, w, http.StatusBadRequest, clientError, clientError)
+		return
+	}
+
+	intPrice, err := strconv.Atoi(price)
+	if err != nil {
+		clientError := fmt.Errorf(BackendError)
+		internalErr := fmt.Errorf("error converting %s to an integer: %v", price, err)
+		errorResponse(ctx, app.tracer, w, http.StatusInternalServerError, clientError, internalErr)
+		return
+	}
+
+	// add new product to the database
+	err = app.createProduct(ctx, code, name, intPrice)
+	if err != nil {
+		clientErr := fmt.Errorf(BackendError)
+		internalErr := fmt.Errorf("error creating product: %v", err)
+		errorResponse(ctx, app.tracer, w, http.StatusInternalServerError, clientErr, internalErr)
+		return
+	}
+
+	response := fmt.Sprintf("Added Product: {Code: %s, Name: %s, Price: %s}", code, name, price)
+	okResponse(ctx, app.tracer, w, response)
+}
+
+func main() {
+	ctx := context.Background()
+	tracer, shutdown := tracing.NewTracer(ctx, "gorm-demo-otel")
+	defer shutdown()
+
+	app := NewApp(tracer, "root@/product?charset=utf8mb4&parseTime=True&loc=Local")
+
+	// HTTP handlers, instrumented with otelhttp so each request starts a
+	// root span that the GORM and handler spans above nest under.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", app.Index)
+	mux.HandleFunc("/add", app.Add)
+	mux.HandleFunc("/get", app.Get)
+
+	handler := otelhttp.NewHandler(mux, "gorm-demo-otel")
+	http.ListenAndServe(":8000", handler)
+}
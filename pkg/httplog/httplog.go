@@ -0,0 +1,87 @@
+// Package httplog wraps newrelic.WrapHandleFunc with structured,
+// JSON-formatted request logging via log/slog, with every record enriched
+// with the trace.id, span.id, and entity.guid New Relic needs to correlate
+// logs with the transaction that produced them (Logs in Context).
+package httplog
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// loggerKey is the context key under which the per-request *slog.Logger is
+// stored.
+type loggerKey struct{}
+
+// defaultLogger is used for requests that, for whatever reason, reach a
+// handler without having gone through Wrap.
+var defaultLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// FromContext returns the request-scoped logger stashed by Wrap, or
+// defaultLogger if ctx didn't come from a Wrap-ped handler.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return defaultLogger
+}
+
+// responseWriter records the status code and byte count a handler actually
+// wrote, since http.ResponseWriter defaults to 200 until WriteHeader is
+// called and never reports what was written.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
+
+// Wrap behaves like newrelic.WrapHandleFunc, but additionally logs each
+// request as a single JSON record (method, path, status, duration, bytes)
+// enriched with the transaction's linking metadata, and makes a logger
+// carrying those same fields available to handler via FromContext(r.Context()).
+func Wrap(app *newrelic.Application, pattern string, handler http.HandlerFunc) (string, http.HandlerFunc) {
+	return newrelic.WrapHandleFunc(app, pattern, logRequest(handler))
+}
+
+func logRequest(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		logger := defaultLogger
+		if txn := newrelic.FromContext(r.Context()); txn != nil {
+			metadata := txn.GetLinkingMetadata()
+			logger = logger.With(
+				slog.String("trace.id", metadata.TraceID),
+				slog.String("span.id", metadata.SpanID),
+				slog.String("entity.guid", metadata.EntityGUID),
+			)
+		}
+
+		next(rw, r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger)))
+
+		logger.Info("request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rw.status),
+			slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+			slog.Int("bytes", rw.bytes),
+		)
+	}
+}
@@ -0,0 +1,258 @@
+// Package migrate runs versioned SQL migrations from an embedded directory,
+// tracking which ones have been applied in a schema_migrations table. It
+// replaces relying on gorm.AutoMigrate for schema changes that AutoMigrate
+// cannot express safely (column drops, backfills, unique indexes, ...).
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// filenamePattern matches migration files named like "0001_init.up.sql" or
+// "0001_init.down.sql".
+var filenamePattern = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// migration is a single versioned schema change, loaded from a matching
+// "<version>_<name>.up.sql" / "<version>_<name>.down.sql" pair.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// Status describes whether a single migration has been applied.
+type Status struct {
+	Version int
+	Name    string
+	Applied bool
+}
+
+// Migrator applies and rolls back the migrations found in dir within fsys
+// against db, recording progress in a schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	migrations []migration
+}
+
+// New loads every "<version>_<name>.up.sql"/".down.sql" pair found in dir
+// within fsys and returns a Migrator that applies them against db. dir is
+// typically the root of an embed.FS populated with //go:embed migrations.
+func New(db *sql.DB, fsys fs.FS, dir string) (*Migrator, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: reading %s: %w", dir, err)
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		match := filenamePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("migrate: invalid version in %s: %w", entry.Name(), err)
+		}
+
+		contents, err := fs.ReadFile(fsys, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("migrate: reading %s: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		}
+		if match[3] == "up" {
+			m.up = trimSQL(string(contents))
+		} else {
+			m.down = trimSQL(string(contents))
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// ensureSchemaMigrationsTable creates the bookkeeping table if it doesn't
+// already exist.
+func (m *Migrator) ensureSchemaMigrationsTable(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL
+	)`)
+	return err
+}
+
+// applied returns the set of migration versions already recorded in
+// schema_migrations.
+func (m *Migrator) applied(ctx context.Context) (map[int]bool, error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// runStep executes every ";"-separated statement in script against the
+// database, traced as a single "migrate:<version>" segment when ctx
+// carries a *newrelic.Transaction.
+func (m *Migrator) runStep(ctx context.Context, version int, script string) error {
+	if txn := newrelic.FromContext(ctx); txn != nil {
+		defer txn.StartSegment(fmt.Sprintf("migrate:%d", version)).End()
+	}
+
+	for _, stmt := range strings.Split(script, ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt == "" {
+			continue
+		}
+		if _, err := m.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Up applies every migration that has not yet been recorded in
+// schema_migrations, in version order.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.Goto(ctx, m.latestVersion())
+}
+
+// Down rolls back the most recently applied migration.
+func (m *Migrator) Down(ctx context.Context) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	target := 0
+	for _, s := range statuses {
+		if s.Applied && s.Version > target {
+			target = s.Version
+		}
+	}
+
+	var previous int
+	for _, s := range statuses {
+		if s.Applied && s.Version < target {
+			previous = s.Version
+		}
+	}
+
+	if target == 0 {
+		return nil
+	}
+	return m.Goto(ctx, previous)
+}
+
+// Goto migrates the database to exactly version, running up migrations if
+// version is ahead of the current state or down migrations if it is
+// behind. A version of 0 rolls back every migration.
+func (m *Migrator) Goto(ctx context.Context, version int) error {
+	if err := m.ensureSchemaMigrationsTable(ctx); err != nil {
+		return err
+	}
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Apply pending up migrations oldest-first.
+	for _, mg := range m.migrations {
+		if mg.version <= version && !applied[mg.version] {
+			if err := m.runStep(ctx, mg.version, mg.up); err != nil {
+				return fmt.Errorf("migrate: applying %d_%s: %w", mg.version, mg.name, err)
+			}
+			if _, err := m.db.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", mg.version, mg.name); err != nil {
+				return fmt.Errorf("migrate: recording %d_%s: %w", mg.version, mg.name, err)
+			}
+		}
+	}
+
+	// Revert applied-but-now-out-of-range migrations newest-first, since a
+	// later migration's down-script may assume an earlier one is still in
+	// place.
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mg := m.migrations[i]
+		if mg.version > version && applied[mg.version] {
+			if err := m.runStep(ctx, mg.version, mg.down); err != nil {
+				return fmt.Errorf("migrate: reverting %d_%s: %w", mg.version, mg.name, err)
+			}
+			if _, err := m.db.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", mg.version); err != nil {
+				return fmt.Errorf("migrate: un-recording %d_%s: %w", mg.version, mg.name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Status reports, for every known migration, whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.ensureSchemaMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, len(m.migrations))
+	for i, mg := range m.migrations {
+		statuses[i] = Status{Version: mg.version, Name: mg.name, Applied: applied[mg.version]}
+	}
+	return statuses, nil
+}
+
+func (m *Migrator) latestVersion() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].version
+}
+
+func (s Status) String() string {
+	state := "pending"
+	if s.Applied {
+		state = "applied"
+	}
+	return fmt.Sprintf("%04d_%s: %s", s.Version, s.Name, state)
+}
+
+// trimSQL strips surrounding whitespace so single-statement files with a
+// trailing newline don't trip drivers that reject empty trailing
+// statements.
+func trimSQL(s string) string {
+	return strings.TrimSpace(s)
+}
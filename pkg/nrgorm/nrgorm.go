@@ -0,0 +1,150 @@
+// Package nrgorm instruments GORM database calls with New Relic
+// DatastoreSegments via a gorm.Plugin, so callers no longer need to wrap
+// every query helper in a manual newrelic.Transaction.StartSegment call.
+//
+// Register it once against a *gorm.DB:
+//
+//	gormdb.Use(nrgorm.New(newrelic.DatastoreMySQL))
+//
+// and make sure the *newrelic.Transaction for the current request is on the
+// context passed to WithContext (e.g. via r.Context() inside a handler
+// wrapped with newrelic.WrapHandleFunc).
+package nrgorm
+
+import (
+	"context"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+	"gorm.io/gorm"
+)
+
+// Plugin is a gorm.Plugin that starts a DatastoreSegment before each query
+// and ends it (recording rows affected and any error) afterward.
+type Plugin struct {
+	product newrelic.DatastoreProduct
+}
+
+// New returns a Plugin that tags every DatastoreSegment it creates with
+// product (e.g. newrelic.DatastoreMySQL, newrelic.DatastorePostgres).
+func New(product newrelic.DatastoreProduct) *Plugin {
+	return &Plugin{product: product}
+}
+
+// Name implements gorm.Plugin.
+func (p *Plugin) Name() string {
+	return "nrgorm"
+}
+
+// Initialize implements gorm.Plugin. It registers before/after callbacks on
+// every GORM operation that issues SQL. The callback accessors
+// (db.Callback().Create(), etc.) return an unexported type, so each
+// operation is registered inline rather than through a shared helper.
+func (p *Plugin) Initialize(db *gorm.DB) error {
+	if cb := db.Callback().Create(); cb != nil {
+		if err := cb.Before("gorm:create").Register("nrgorm:before_create", p.before()); err != nil {
+			return err
+		}
+		if err := cb.After("gorm:create").Register("nrgorm:after_create", p.after("create")); err != nil {
+			return err
+		}
+	}
+
+	if cb := db.Callback().Query(); cb != nil {
+		if err := cb.Before("gorm:query").Register("nrgorm:before_query", p.before()); err != nil {
+			return err
+		}
+		if err := cb.After("gorm:query").Register("nrgorm:after_query", p.after("query")); err != nil {
+			return err
+		}
+	}
+
+	if cb := db.Callback().Update(); cb != nil {
+		if err := cb.Before("gorm:update").Register("nrgorm:before_update", p.before()); err != nil {
+			return err
+		}
+		if err := cb.After("gorm:update").Register("nrgorm:after_update", p.after("update")); err != nil {
+			return err
+		}
+	}
+
+	if cb := db.Callback().Delete(); cb != nil {
+		if err := cb.Before("gorm:delete").Register("nrgorm:before_delete", p.before()); err != nil {
+			return err
+		}
+		if err := cb.After("gorm:delete").Register("nrgorm:after_delete", p.after("delete")); err != nil {
+			return err
+		}
+	}
+
+	if cb := db.Callback().Row(); cb != nil {
+		if err := cb.Before("gorm:row").Register("nrgorm:before_row", p.before()); err != nil {
+			return err
+		}
+		if err := cb.After("gorm:row").Register("nrgorm:after_row", p.after("row")); err != nil {
+			return err
+		}
+	}
+
+	if cb := db.Callback().Raw(); cb != nil {
+		if err := cb.Before("gorm:raw").Register("nrgorm:before_raw", p.before()); err != nil {
+			return err
+		}
+		if err := cb.After("gorm:raw").Register("nrgorm:after_raw", p.after("raw")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type startTimeKey struct{}
+
+// before stashes a SegmentStartTime on the statement context so the
+// matching after callback can build a DatastoreSegment with accurate
+// timing. It runs before GORM builds and executes the SQL for this
+// operation, so db.Statement.SQL is not yet populated here.
+func (p *Plugin) before() func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		txn := newrelic.FromContext(db.Statement.Context)
+		if txn == nil {
+			return
+		}
+
+		ctx := context.WithValue(db.Statement.Context, startTimeKey{}, txn.StartSegmentNow())
+		db.Statement.Context = ctx
+	}
+}
+
+// after builds and ends a DatastoreSegment for op using the start time
+// stashed by before, recording the query and reporting any statement
+// error to the transaction. It runs after GORM has built and executed
+// the SQL, so db.Statement.SQL.String() now reflects what was actually
+// run.
+func (p *Plugin) after(op string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		startTime, ok := db.Statement.Context.Value(startTimeKey{}).(newrelic.SegmentStartTime)
+		if !ok {
+			return
+		}
+		txn := newrelic.FromContext(db.Statement.Context)
+		if txn == nil {
+			return
+		}
+
+		segment := &newrelic.DatastoreSegment{
+			Product:            p.product,
+			Collection:         db.Statement.Table,
+			Operation:          op,
+			ParameterizedQuery: db.Statement.SQL.String(),
+			QueryParameters: map[string]interface{}{
+				"RowsAffected": db.Statement.RowsAffected,
+			},
+			StartTime: startTime,
+		}
+		segment.End()
+
+		if db.Statement.Error != nil {
+			txn.NoticeError(db.Statement.Error)
+		}
+	}
+}
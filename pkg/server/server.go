@@ -0,0 +1,44 @@
+// Package server runs an http.Server until its context is canceled, then
+// drains in-flight requests and hands off to a caller-supplied cleanup
+// before returning. It factors out the graceful-shutdown loop that used to
+// be duplicated across this repo's example apps.
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout bounds how long Serve waits for in-flight requests to
+// drain before giving up.
+const shutdownTimeout = 10 * time.Second
+
+// Serve starts an HTTP server with handler on addr and blocks until ctx is
+// canceled (e.g. by SIGINT/SIGTERM). On cancellation it drains in-flight
+// requests via http.Server.Shutdown, then calls cleanup (e.g. to flush a
+// New Relic agent and close a *sql.DB) before returning.
+func Serve(ctx context.Context, addr string, handler http.Handler, cleanup func()) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serveErr <- err
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+
+	cleanup()
+
+	return err
+}
@@ -0,0 +1,314 @@
+// Copyright 2020 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// postgres database hosted in local container for this example
+// podman run --name postgres -p 5432:5432 -e POSTGRES_PASSWORD=postgres -e POSTGRES_DB=product postgres
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	// Import newrelic database driver as custom driver
+	// GORM will automatically use this driver as its postgres driver
+	// https://gorm.io/docs/connecting_to_the_database.html#Customize-Driver
+	_ "github.com/newrelic/go-agent/v3/integrations/nrpgx"
+
+	"github.com/iamemilio/gorm-instrumentation-demo/pkg/httplog"
+	"github.com/iamemilio/gorm-instrumentation-demo/pkg/nrgorm"
+	"github.com/iamemilio/gorm-instrumentation-demo/pkg/server"
+	"github.com/newrelic/go-agent/v3/newrelic"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+type App struct {
+	goAgent       *newrelic.Application
+	db            *gorm.DB
+	stopPoolStats func()
+}
+
+type Product struct {
+	gorm.Model
+	Code  string
+	Name  string
+	Price int
+}
+
+const (
+	BackendError = "backend error"
+
+	// defaults used when the corresponding env var is unset or invalid
+	defaultMaxOpenConns    = 25
+	defaultMaxIdleConns    = 25
+	defaultConnMaxLifetime = 5 * time.Minute
+	poolStatsInterval      = 15 * time.Second
+)
+
+// handler for formatting and sending bad request messages
+func errorResponse(ctx context.Context, w http.ResponseWriter, txn *newrelic.Transaction, errorNumber int, clientError, internalError string) {
+	defer txn.StartSegment("errorResponse").End()
+
+	// log error locally, correlated with the transaction via httplog
+	httplog.FromContext(ctx).Error(internalError)
+
+	// send http error to client
+	// because our app sets the response number header to an error
+	// the Go agent will automatically detect it as an error
+	w.WriteHeader(errorNumber)
+	strError := strconv.Itoa(errorNumber)
+	response := fmt.Sprintf("%s - %s", strError, clientError)
+	w.Write([]byte(response))
+}
+
+// handler for formatting and sending ok request messages
+func okResponse(w http.ResponseWriter, txn *newrelic.Transaction, message string) {
+	defer txn.StartSegment("okResponse").End()
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(message))
+}
+
+// API endpoing for the root of the application
+// Serves a static HTTP file
+func Index(w http.ResponseWriter, r *http.Request) {
+	txn := newrelic.FromContext(r.Context())
+	defer txn.StartSegment("Index").End()
+
+	p := "." + r.URL.Path
+	if p == "./" {
+		p = "./index.html"
+	}
+	http.ServeFile(w, r, p)
+}
+
+// API endpoint for the /get pattern
+// gets a single Product from the database by either Name or Code
+func (app *App) Get(w http.ResponseWriter, r *http.Request) {
+	txn := newrelic.FromContext(r.Context())
+
+	// polulate r.Form
+	err := r.ParseForm()
+	if err != nil {
+		internalError := fmt.Sprintf("error parsing form during GET operation: %v", err)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalError)
+		return
+	}
+
+	// get arguments from http Form
+	code := r.Form.Get("code")
+	name := strings.ToLower(r.Form.Get("name"))
+
+	// lookup product based on arguments
+	var product Product
+	gormdb := app.db.WithContext(r.Context())
+	if code != "" {
+		err = gormdb.First(&product, "code = ?", code).Error
+	} else if name != "" {
+		err = gormdb.First(&product, "name = ?", name).Error
+	} else {
+		msg := fmt.Sprintf("bad request: either name or code must be provided for get")
+		errorResponse(r.Context(), w, txn, http.StatusBadRequest, msg, msg)
+		return
+	}
+
+	if err != nil {
+		internalError := fmt.Sprintf("unable to GET product: %v", err)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalError)
+	} else {
+		response := fmt.Sprintf("%s,%s: $%s", product.Name, product.Code, strconv.Itoa(product.Price))
+		okResponse(w, txn, response)
+	}
+}
+
+// API endpoint for the /add pattern
+// adds a single entry to the database
+func (app *App) Add(w http.ResponseWriter, r *http.Request) {
+	txn := newrelic.FromContext(r.Context())
+
+	// Populate r.Form
+	err := r.ParseForm()
+	if err != nil {
+		internalErr := fmt.Sprintf("error parsing form when adding product: %v", err)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalErr)
+		return
+	}
+
+	// Parse arguments from r.Form
+	code := r.Form.Get("code")
+	name := strings.ToLower(r.Form.Get("name"))
+	price := r.Form.Get("price")
+
+	if code == "" || name == "" || price == "" {
+		clientError := fmt.Sprintf("bad request: code, name, and price can not be empty")
+		errorResponse(r.Context(), w, txn, http.StatusBadRequest, clientError, clientError)
+		return
+	}
+
+	intPrice, err := strconv.Atoi(price)
+	if err != nil {
+		internalErr := fmt.Sprintf("error converting %s to an integer: %v", price, err)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalErr)
+		return
+	}
+
+	// add new product to the database
+	gormdb := app.db.WithContext(r.Context())
+	err = gormdb.Create(&Product{
+		Code:  code,
+		Name:  name,
+		Price: intPrice,
+	}).Error
+
+	if err != nil {
+		internalErr := fmt.Sprintf("error creating product: %v", err)
+		errorResponse(r.Context(), w, txn, http.StatusInternalServerError, BackendError, internalErr)
+		return
+	}
+
+	response := fmt.Sprintf("Added Product: {Code: %s, Name: %s, Price: %s}", code, name, price)
+	okResponse(w, txn, response)
+}
+
+// envInt reads name from the environment as an int, falling back to def if
+// the variable is unset or not a valid integer.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// envDuration reads name from the environment as a Duration, falling back
+// to def if the variable is unset or not a valid duration.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// recordPoolStats reports sql.DB connection pool stats as New Relic custom
+// metrics on a ticker, so pool exhaustion and tuning show up in APM
+// alongside the datastore segments the nrpgx driver records. The returned
+// func stops the ticker.
+func recordPoolStats(goAgent *newrelic.Application, sqlDB *sql.DB) func() {
+	ticker := time.NewTicker(poolStatsInterval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				stats := sqlDB.Stats()
+				goAgent.RecordCustomMetric("Custom/DBPool/OpenConnections", float64(stats.OpenConnections))
+				goAgent.RecordCustomMetric("Custom/DBPool/InUse", float64(stats.InUse))
+				goAgent.RecordCustomMetric("Custom/DBPool/Idle", float64(stats.Idle))
+				goAgent.RecordCustomMetric("Custom/DBPool/WaitCount", float64(stats.WaitCount))
+				goAgent.RecordCustomMetric("Custom/DBPool/WaitDurationMs", float64(stats.WaitDuration.Milliseconds()))
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// NewApp initializes an App backed by Postgres through the nrpgx driver,
+// with connection pool limits configured from DB_MAX_OPEN_CONNS,
+// DB_MAX_IDLE_CONNS, and DB_CONN_MAX_LIFETIME. Pool stats are reported to
+// goAgent as custom metrics on a ticker.
+func NewApp(goAgent *newrelic.Application, connectionString string) *App {
+	gormdb, err := gorm.Open(postgres.New(postgres.Config{
+		DriverName: "nrpgx",
+		DSN:        connectionString,
+	}), &gorm.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Register the nrgorm plugin so every query on gormdb gets a
+	// DatastoreSegment, instead of hand-wrapping each helper below.
+	if err := gormdb.Use(nrgorm.New(newrelic.DatastorePostgres)); err != nil {
+		log.Fatal(err)
+	}
+
+	sqlDB, err := gormdb.DB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(envInt("DB_MAX_OPEN_CONNS", defaultMaxOpenConns))
+	sqlDB.SetMaxIdleConns(envInt("DB_MAX_IDLE_CONNS", defaultMaxIdleConns))
+	sqlDB.SetConnMaxLifetime(envDuration("DB_CONN_MAX_LIFETIME", defaultConnMaxLifetime))
+	stopPoolStats := recordPoolStats(goAgent, sqlDB)
+
+	// Migrate the schema
+	gormdb.AutoMigrate(&Product{})
+
+	return &App{goAgent: goAgent, db: gormdb, stopPoolStats: stopPoolStats}
+}
+
+// Run starts the HTTP server on addr and blocks until ctx is canceled (e.g.
+// by SIGINT/SIGTERM), at which point it drains in-flight requests, flushes
+// the New Relic agent, and closes the underlying *sql.DB.
+func (app *App) Run(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(httplog.Wrap(app.goAgent, "/", Index))
+	mux.HandleFunc(httplog.Wrap(app.goAgent, "/add", app.Add))
+	mux.HandleFunc(httplog.Wrap(app.goAgent, "/get", app.Get))
+
+	return server.Serve(ctx, addr, mux, func() {
+		app.stopPoolStats()
+		app.goAgent.Shutdown(10 * time.Second)
+
+		if sqlDB, err := app.db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
+
+func main() {
+	appName := "gorm-postgres-app"
+
+	// initialize new relic go agent app
+	goAgent, err := newrelic.NewApplication(
+		newrelic.ConfigAppName(appName),
+		newrelic.ConfigFromEnvironment(),
+		newrelic.ConfigDistributedTracerEnabled(true),
+		newrelic.ConfigDebugLogger(os.Stdout),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Initialize database connection
+	app := NewApp(goAgent, "host=localhost user=postgres password=postgres dbname=product sslmode=disable")
+
+	// Run until SIGINT/SIGTERM, then drain in-flight requests and flush
+	// the New Relic agent so no data is lost on shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := app.Run(ctx, ":8000"); err != nil {
+		log.Fatal(err)
+	}
+}